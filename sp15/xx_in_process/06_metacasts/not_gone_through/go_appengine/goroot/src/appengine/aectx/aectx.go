@@ -0,0 +1,136 @@
+// Copyright 2011 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package aectx bridges the legacy appengine.Context interface to the
+// standard context.Context, mirroring the surface of
+// google.golang.org/appengine/v2 (Middleware, NewContext, WithContext,
+// APICall) so that handlers can be migrated off appengine.Context
+// incrementally. It is implemented in terms of appengine.NewContext and
+// appengine.Context.Call, so it reaches the same underlying
+// appengine_internal RPC path as the rest of this package.
+package aectx
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"appengine"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ctxKey is the context.Context key under which the legacy
+// appengine.Context is stored.
+type ctxKey struct{}
+
+// NewContext returns a context.Context carrying the legacy
+// appengine.Context for r. It is the context.Context analogue of
+// appengine.NewContext.
+func NewContext(r *http.Request) context.Context {
+	return WithContext(context.Background(), r)
+}
+
+// WithContext returns a copy of parent carrying the legacy
+// appengine.Context for r.
+func WithContext(parent context.Context, r *http.Request) context.Context {
+	return context.WithValue(parent, ctxKey{}, appengine.NewContext(r))
+}
+
+// Middleware wraps next so that every request it serves carries a
+// context.Context layered on top of r.Context() via WithContext,
+// retrievable from later handlers via r.Context() and usable with APICall
+// and the other functions in this package. Using r.Context() as the parent
+// preserves any values, deadlines, or cancellation (e.g. on client
+// disconnect) already attached by upstream middleware or the server.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithContext(r.Context(), r)))
+	})
+}
+
+// legacy extracts the appengine.Context stashed in ctx by NewContext or
+// WithContext.
+func legacy(ctx context.Context) (appengine.Context, error) {
+	c, ok := ctx.Value(ctxKey{}).(appengine.Context)
+	if !ok {
+		return nil, errors.New("aectx: context was not derived from NewContext or WithContext")
+	}
+	return c, nil
+}
+
+// APICall invokes the named service RPC using the legacy appengine.Context
+// stashed in ctx, the same way appengine.Context.Call does.
+func APICall(ctx context.Context, service, method string, in, out proto.Message) error {
+	c, err := legacy(ctx)
+	if err != nil {
+		return err
+	}
+	return c.Call(service, method, in, out, nil)
+}
+
+// AppID is the context.Context analogue of appengine.AppID.
+func AppID(ctx context.Context) (string, error) {
+	c, err := legacy(ctx)
+	if err != nil {
+		return "", err
+	}
+	return appengine.AppID(c), nil
+}
+
+// VersionID is the context.Context analogue of appengine.VersionID.
+func VersionID(ctx context.Context) (string, error) {
+	c, err := legacy(ctx)
+	if err != nil {
+		return "", err
+	}
+	return appengine.VersionID(c), nil
+}
+
+// ModuleHostname is the context.Context analogue of appengine.ModuleHostname.
+func ModuleHostname(ctx context.Context, module, version, instance string) (string, error) {
+	c, err := legacy(ctx)
+	if err != nil {
+		return "", err
+	}
+	return appengine.ModuleHostname(c, module, version, instance)
+}
+
+// AccessToken is the context.Context analogue of appengine.AccessToken.
+func AccessToken(ctx context.Context, scopes ...string) (token string, expiry time.Time, err error) {
+	c, err := legacy(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return appengine.AccessToken(c, scopes...)
+}
+
+// SignBytes is the context.Context analogue of appengine.SignBytes.
+func SignBytes(ctx context.Context, bytes []byte) (keyName string, signature []byte, err error) {
+	c, err := legacy(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	return appengine.SignBytes(c, bytes)
+}
+
+// PublicCertificates is the context.Context analogue of
+// appengine.PublicCertificates.
+func PublicCertificates(ctx context.Context) ([]appengine.Certificate, error) {
+	c, err := legacy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return appengine.PublicCertificates(c)
+}
+
+// ServiceAccount is the context.Context analogue of appengine.ServiceAccount.
+func ServiceAccount(ctx context.Context) (string, error) {
+	c, err := legacy(ctx)
+	if err != nil {
+		return "", err
+	}
+	return appengine.ServiceAccount(c)
+}
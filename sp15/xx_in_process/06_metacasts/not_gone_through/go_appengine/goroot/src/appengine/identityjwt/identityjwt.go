@@ -0,0 +1,267 @@
+// Copyright 2011 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package identityjwt issues and verifies RS256 JSON Web Tokens signed by
+// the application's service account, using appengine.SignBytes and
+// appengine.PublicCertificates rather than a locally held private key.
+package identityjwt
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"appengine"
+)
+
+// header is the JOSE header of a JWT signed or verified by this package.
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// SignJWT signs claims as a compact-serialized RS256 JWT using the
+// application's service account key. The JWT header's "kid" is set to the
+// KeyName that appengine.SignBytes actually signed with, so that VerifyJWT
+// (or any relying party fetching appengine.PublicCertificates) can select
+// the matching certificate. SignJWT sets the "iat" and "exp" claims itself
+// based on ttl; an "iss" claim is added from appengine.ServiceAccount
+// unless claims already supplies one.
+func SignJWT(c appengine.Context, claims map[string]interface{}, ttl time.Duration) (string, error) {
+	now := time.Now()
+	all := make(map[string]interface{}, len(claims)+3)
+	for k, v := range claims {
+		all[k] = v
+	}
+	all["iat"] = now.Unix()
+	all["exp"] = now.Add(ttl).Unix()
+	if _, ok := all["iss"]; !ok {
+		iss, err := appengine.ServiceAccount(c)
+		if err != nil {
+			return "", fmt.Errorf("identityjwt: resolving issuer: %v", err)
+		}
+		all["iss"] = iss
+	}
+
+	payload, err := json.Marshal(all)
+	if err != nil {
+		return "", fmt.Errorf("identityjwt: marshaling claims: %v", err)
+	}
+	encodedPayload := base64URLEncode(payload)
+
+	// appengine.SignBytes always signs with the app's current key, but
+	// only reveals its KeyName in the response, and the JWT header that
+	// needs to carry that name as "kid" is itself part of the signed
+	// input. Sign the payload alone first to learn the key name, then
+	// build the real header around it and sign the actual signing input.
+	kid, _, err := appengine.SignBytes(c, []byte(encodedPayload))
+	if err != nil {
+		return "", fmt.Errorf("identityjwt: signing: %v", err)
+	}
+	headerJSON, err := json.Marshal(header{Alg: "RS256", Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", fmt.Errorf("identityjwt: marshaling header: %v", err)
+	}
+	signingInput := base64URLEncode(headerJSON) + "." + encodedPayload
+
+	signedBy, sig, err := appengine.SignBytes(c, []byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("identityjwt: signing: %v", err)
+	}
+	if signedBy != kid {
+		return "", fmt.Errorf("identityjwt: signing key rotated mid-request (wanted %s, got %s)", kid, signedBy)
+	}
+	return signingInput + "." + base64URLEncode(sig), nil
+}
+
+// VerifyJWT parses and validates a compact-serialized JWT produced by
+// SignJWT (or any RS256 token signed by this application's service
+// account). It checks the signature against the certificate named by the
+// token's "kid" using a process-wide KeySet cache, and validates the
+// "exp", "iat", "aud" and "iss" claims. audience must match the token's
+// "aud" claim, and iss must match appengine.ServiceAccount(c).
+func VerifyJWT(c appengine.Context, token string, audience string) (map[string]interface{}, error) {
+	parts := splitJWT(token)
+	if len(parts) != 3 {
+		return nil, errors.New("identityjwt: malformed token")
+	}
+	headerJSON, err := base64URLDecode(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("identityjwt: decoding header: %v", err)
+	}
+	var h header
+	if err := json.Unmarshal(headerJSON, &h); err != nil {
+		return nil, fmt.Errorf("identityjwt: parsing header: %v", err)
+	}
+	if h.Alg != "RS256" {
+		return nil, fmt.Errorf("identityjwt: unsupported alg %q", h.Alg)
+	}
+
+	payloadJSON, err := base64URLDecode(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("identityjwt: decoding payload: %v", err)
+	}
+	sig, err := base64URLDecode(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("identityjwt: decoding signature: %v", err)
+	}
+
+	key, err := defaultKeySet.Get(c, h.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("identityjwt: fetching key %q: %v", h.Kid, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("identityjwt: signature verification failed: %v", err)
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payloadJSON, &claims); err != nil {
+		return nil, fmt.Errorf("identityjwt: parsing claims: %v", err)
+	}
+
+	now := time.Now().Unix()
+	exp, ok := numericClaim(claims, "exp")
+	if !ok || now >= exp {
+		return nil, errors.New("identityjwt: token is expired")
+	}
+	if iat, ok := numericClaim(claims, "iat"); ok && now < iat {
+		return nil, errors.New("identityjwt: token used before issued")
+	}
+	if aud, _ := claims["aud"].(string); aud != audience {
+		return nil, fmt.Errorf("identityjwt: aud mismatch: got %q, want %q", aud, audience)
+	}
+	wantIss, err := appengine.ServiceAccount(c)
+	if err != nil {
+		return nil, fmt.Errorf("identityjwt: resolving issuer: %v", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != wantIss {
+		return nil, fmt.Errorf("identityjwt: iss mismatch: got %q, want %q", iss, wantIss)
+	}
+	return claims, nil
+}
+
+// numericClaim returns claims[name] as an int64, handling the float64
+// representation produced by encoding/json.
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return 0, false
+	}
+	return int64(v), true
+}
+
+func splitJWT(token string) []string {
+	parts := make([]string, 0, 3)
+	start := 0
+	for i := 0; i < len(token); i++ {
+		if token[i] == '.' {
+			parts = append(parts, token[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, token[start:])
+	return parts
+}
+
+func base64URLEncode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func base64URLDecode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// defaultKeySet caches the certificates fetched through PublicCertificates
+// for VerifyJWT. Its TTL matches the interval App Engine recommends between
+// refreshes of the app's signing certificates.
+var defaultKeySet = NewKeySet(6 * time.Hour)
+
+// KeySet caches *rsa.PublicKey values parsed from appengine.PublicCertificates,
+// keyed by Certificate.KeyName, so repeated verifications don't re-fetch and
+// re-parse the app's certificates. It is safe for concurrent use.
+type KeySet struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]keySetEntry
+}
+
+type keySetEntry struct {
+	key     *rsa.PublicKey
+	fetched time.Time
+}
+
+// NewKeySet returns a KeySet whose entries are refetched after ttl has
+// elapsed since they were last populated.
+func NewKeySet(ttl time.Duration) *KeySet {
+	return &KeySet{ttl: ttl, entries: make(map[string]keySetEntry)}
+}
+
+// Get returns the RSA public key for keyName, fetching and parsing
+// appengine.PublicCertificates when the cache has no entry for keyName or
+// the cached entry is older than the KeySet's ttl.
+func (k *KeySet) Get(c appengine.Context, keyName string) (*rsa.PublicKey, error) {
+	k.mu.Lock()
+	if e, ok := k.entries[keyName]; ok && time.Since(e.fetched) < k.ttl {
+		k.mu.Unlock()
+		return e.key, nil
+	}
+	k.mu.Unlock()
+
+	certs, err := appengine.PublicCertificates(c)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	for _, cert := range certs {
+		key, err := parseRSAPublicKey(cert.Data)
+		if err != nil {
+			continue
+		}
+		k.entries[cert.KeyName] = keySetEntry{key: key, fetched: now}
+	}
+	e, ok := k.entries[keyName]
+	if !ok {
+		return nil, fmt.Errorf("identityjwt: no certificate named %q", keyName)
+	}
+	return e.key, nil
+}
+
+func parseRSAPublicKey(pemBytes []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("identityjwt: invalid PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("identityjwt: certificate does not contain an RSA public key")
+	}
+	return key, nil
+}
+
+// SignIDToken mints a Google-style ID token: an RS256 JWT whose "iss" is
+// the app's service account, whose "aud" is audience, and which expires
+// after ttl. It is intended for authenticating requests from one module
+// to another, where the receiving module calls VerifyJWT with the same
+// audience to authenticate the caller.
+func SignIDToken(c appengine.Context, audience string, ttl time.Duration) (string, error) {
+	return SignJWT(c, map[string]interface{}{"aud": audience}, ttl)
+}
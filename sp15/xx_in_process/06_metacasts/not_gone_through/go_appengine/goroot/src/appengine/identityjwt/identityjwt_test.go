@@ -0,0 +1,243 @@
+// Copyright 2011 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package identityjwt
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine"
+	pb "appengine_internal/app_identity"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestSplitJWT(t *testing.T) {
+	tests := []struct {
+		token string
+		want  []string
+	}{
+		{"a.b.c", []string{"a", "b", "c"}},
+		{"", []string{""}},
+		{"header.payload.", []string{"header", "payload", ""}},
+		{"a.b.c.d", []string{"a", "b", "c.d"}},
+	}
+	for _, tt := range tests {
+		got := splitJWT(tt.token)
+		if len(got) != len(tt.want) {
+			t.Errorf("splitJWT(%q) = %q, want %q", tt.token, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("splitJWT(%q) = %q, want %q", tt.token, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestNumericClaim(t *testing.T) {
+	claims := map[string]interface{}{
+		"exp":    float64(1700000000),
+		"string": "not a number",
+	}
+	if got, ok := numericClaim(claims, "exp"); !ok || got != 1700000000 {
+		t.Errorf("numericClaim(claims, %q) = (%v, %v), want (1700000000, true)", "exp", got, ok)
+	}
+	if _, ok := numericClaim(claims, "string"); ok {
+		t.Errorf("numericClaim(claims, %q) ok = true, want false", "string")
+	}
+	if _, ok := numericClaim(claims, "missing"); ok {
+		t.Errorf("numericClaim(claims, %q) ok = true, want false", "missing")
+	}
+}
+
+func TestKeySetCacheHit(t *testing.T) {
+	ks := NewKeySet(time.Hour)
+	ks.entries["key1"] = keySetEntry{key: nil, fetched: time.Now()}
+
+	// A cache hit is served without touching the appengine.Context, so
+	// passing nil is safe here: Get only reaches PublicCertificates(c) on
+	// a miss or an expired entry.
+	key, err := ks.Get(nil, "key1")
+	if err != nil {
+		t.Fatalf("Get(nil, %q) returned error %v, want nil", "key1", err)
+	}
+	if key != nil {
+		t.Errorf("Get(nil, %q) = %v, want nil (the cached entry's key)", "key1", key)
+	}
+}
+
+func TestKeySetExpiredEntryIsNotServedFromCache(t *testing.T) {
+	ks := NewKeySet(time.Millisecond)
+	ks.entries["key1"] = keySetEntry{key: nil, fetched: time.Now().Add(-time.Hour)}
+
+	// The entry is stale, so Get must fall through to
+	// appengine.PublicCertificates(c), which panics on a nil Context --
+	// proving the cache did not short-circuit the lookup.
+	defer func() {
+		if recover() == nil {
+			t.Error("Get did not attempt to refresh an expired entry")
+		}
+	}()
+	ks.Get(nil, "key1")
+}
+
+// fakeContext is a minimal appengine.Context backed by an in-memory RSA
+// key pair, standing in for the app_identity service so that SignJWT and
+// VerifyJWT can be exercised end to end without a real App Engine
+// environment. keyName identifies both the signing key SignForApp reports
+// and the certificate GetPublicCertificatesForApp serves, mirroring how
+// the real service ties a SignBytes response to a PublicCertificates
+// entry.
+type fakeContext struct {
+	appengine.Context
+	serviceAccount string
+	keyName        string
+	key            *rsa.PrivateKey
+	certDER        []byte
+}
+
+// newFakeContext generates a fresh RSA key pair and a self-signed
+// certificate wrapping its public half, so defaultKeySet can parse it the
+// same way it parses a real app_identity certificate.
+func newFakeContext(t *testing.T, serviceAccount, keyName string) *fakeContext {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: keyName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	return &fakeContext{serviceAccount: serviceAccount, keyName: keyName, key: key, certDER: der}
+}
+
+func (f *fakeContext) Call(service, method string, in, out proto.Message, opts *appengine.CallOptions) error {
+	if service != "app_identity_service" {
+		return fmt.Errorf("fakeContext: unexpected service %q", service)
+	}
+	switch method {
+	case "SignForApp":
+		req := in.(*pb.SignForAppRequest)
+		digest := sha256.Sum256(req.BytesToSign)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+		if err != nil {
+			return err
+		}
+		res := out.(*pb.SignForAppResponse)
+		res.KeyName = proto.String(f.keyName)
+		res.SignatureBytes = sig
+		return nil
+	case "GetPublicCertificatesForApp":
+		res := out.(*pb.GetPublicCertificateForAppResponse)
+		res.PublicCertificateList = []*pb.PublicCertificate{{
+			KeyName:            proto.String(f.keyName),
+			X509CertificatePem: proto.String(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.certDER}))),
+		}}
+		return nil
+	case "GetServiceAccountName":
+		res := out.(*pb.GetServiceAccountNameResponse)
+		res.ServiceAccountName = proto.String(f.serviceAccount)
+		return nil
+	default:
+		return fmt.Errorf("fakeContext: unexpected method %q", method)
+	}
+}
+
+func TestSignJWTVerifyJWTRoundTrip(t *testing.T) {
+	c := newFakeContext(t, "app@example.appspot.gserviceaccount.com", "round-trip-key")
+	token, err := SignJWT(c, map[string]interface{}{"aud": "my-service", "sub": "user-1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("SignJWT returned error %v", err)
+	}
+
+	claims, err := VerifyJWT(c, token, "my-service")
+	if err != nil {
+		t.Fatalf("VerifyJWT returned error %v, want nil", err)
+	}
+	if claims["sub"] != "user-1" {
+		t.Errorf("claims[%q] = %v, want %q", "sub", claims["sub"], "user-1")
+	}
+	if claims["iss"] != "app@example.appspot.gserviceaccount.com" {
+		t.Errorf("claims[%q] = %v, want the service account", "iss", claims["iss"])
+	}
+}
+
+func TestVerifyJWTRejectsExpiredToken(t *testing.T) {
+	c := newFakeContext(t, "app@example.appspot.gserviceaccount.com", "expired-key")
+	token, err := SignJWT(c, map[string]interface{}{"aud": "my-service"}, -time.Minute)
+	if err != nil {
+		t.Fatalf("SignJWT returned error %v", err)
+	}
+	if _, err := VerifyJWT(c, token, "my-service"); err == nil {
+		t.Error("VerifyJWT accepted an expired token")
+	}
+}
+
+func TestVerifyJWTRejectsWrongAudience(t *testing.T) {
+	c := newFakeContext(t, "app@example.appspot.gserviceaccount.com", "aud-key")
+	token, err := SignJWT(c, map[string]interface{}{"aud": "my-service"}, time.Hour)
+	if err != nil {
+		t.Fatalf("SignJWT returned error %v", err)
+	}
+	if _, err := VerifyJWT(c, token, "other-service"); err == nil {
+		t.Error("VerifyJWT accepted a token with the wrong audience")
+	}
+}
+
+func TestVerifyJWTRejectsWrongIssuer(t *testing.T) {
+	c := newFakeContext(t, "app@example.appspot.gserviceaccount.com", "iss-key")
+	// Supplying an explicit "iss" claim bypasses the default of resolving
+	// it from appengine.ServiceAccount, letting the token disagree with
+	// what the verifying Context reports.
+	token, err := SignJWT(c, map[string]interface{}{"aud": "my-service", "iss": "someone-else@example.com"}, time.Hour)
+	if err != nil {
+		t.Fatalf("SignJWT returned error %v", err)
+	}
+	if _, err := VerifyJWT(c, token, "my-service"); err == nil {
+		t.Error("VerifyJWT accepted a token with the wrong issuer")
+	}
+}
+
+func TestVerifyJWTRejectsTamperedSignature(t *testing.T) {
+	c := newFakeContext(t, "app@example.appspot.gserviceaccount.com", "tamper-key")
+	token, err := SignJWT(c, map[string]interface{}{"aud": "my-service"}, time.Hour)
+	if err != nil {
+		t.Fatalf("SignJWT returned error %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	sig := []rune(parts[2])
+	for i, r := range sig {
+		if r != 'A' {
+			sig[i] = 'A'
+			break
+		}
+	}
+	tampered := parts[0] + "." + parts[1] + "." + string(sig)
+
+	if _, err := VerifyJWT(c, tampered, "my-service"); err == nil {
+		t.Error("VerifyJWT accepted a token with a tampered signature")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2011 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package modules provides functions for interacting with the modules and
+// versions of an App Engine application, including listing them and
+// controlling the number of running instances.
+package modules
+
+import (
+	"appengine"
+	"appengine_internal"
+	modpb "appengine_internal/modules"
+)
+
+// List returns the names of modules belonging to this application.
+func List(c appengine.Context) ([]string, error) {
+	req := &modpb.GetModulesRequest{}
+	res := &modpb.GetModulesResponse{}
+	if err := c.Call("modules", "GetModules", req, res, nil); err != nil {
+		return nil, err
+	}
+	return res.Module, nil
+}
+
+// Versions returns the names of versions that have been deployed to the
+// given module. If module is the empty string, it refers to the module of
+// the current instance.
+func Versions(c appengine.Context, module string) ([]string, error) {
+	req := &modpb.GetVersionsRequest{}
+	if module != "" {
+		req.Module = &module
+	}
+	res := &modpb.GetVersionsResponse{}
+	if err := c.Call("modules", "GetVersions", req, res, nil); err != nil {
+		return nil, err
+	}
+	return res.Version, nil
+}
+
+// DefaultVersion returns the default version of the given module. If
+// module is the empty string, it refers to the module of the current
+// instance.
+func DefaultVersion(c appengine.Context, module string) (string, error) {
+	req := &modpb.GetDefaultVersionRequest{}
+	if module != "" {
+		req.Module = &module
+	}
+	res := &modpb.GetDefaultVersionResponse{}
+	if err := c.Call("modules", "GetDefaultVersion", req, res, nil); err != nil {
+		return "", err
+	}
+	return res.GetVersion(), nil
+}
+
+// NumInstances returns the number of instances that are set to run for the
+// given module version. If module or version is the empty string, it
+// refers to the module or version of the current instance. NumInstances
+// cannot be called on an automatically-scaled module version.
+func NumInstances(c appengine.Context, module, version string) (int, error) {
+	req := &modpb.GetNumInstancesRequest{}
+	if module != "" {
+		req.Module = &module
+	}
+	if version != "" {
+		req.Version = &version
+	}
+	res := &modpb.GetNumInstancesResponse{}
+	if err := c.Call("modules", "GetNumInstances", req, res, nil); err != nil {
+		return 0, err
+	}
+	return int(res.GetInstances()), nil
+}
+
+// SetNumInstances sets the number of instances that should be running for
+// the given module version. If module or version is the empty string, it
+// refers to the module or version of the current instance.
+func SetNumInstances(c appengine.Context, module, version string, instances int) error {
+	req := &modpb.SetNumInstancesRequest{Instances: proto64(int64(instances))}
+	if module != "" {
+		req.Module = &module
+	}
+	if version != "" {
+		req.Version = &version
+	}
+	res := &modpb.SetNumInstancesResponse{}
+	return c.Call("modules", "SetNumInstances", req, res, nil)
+}
+
+// StartVersion starts all instances of the given module version. Unlike
+// the other functions in this package, module and version are required:
+// they name the manually-scaled module version to start, not the module
+// or version of the current instance.
+func StartVersion(c appengine.Context, module, version string) error {
+	req := &modpb.StartModuleRequest{Module: &module, Version: &version}
+	res := &modpb.StartModuleResponse{}
+	return c.Call("modules", "StartModule", req, res, nil)
+}
+
+// StopVersion stops all instances of the given module version. Unlike the
+// other functions in this package, module and version are required: they
+// name the manually-scaled module version to stop, not the module or
+// version of the current instance.
+func StopVersion(c appengine.Context, module, version string) error {
+	req := &modpb.StopModuleRequest{Module: &module, Version: &version}
+	res := &modpb.StopModuleResponse{}
+	return c.Call("modules", "StopModule", req, res, nil)
+}
+
+// ModuleHostname returns a hostname of a module instance.
+// If module is the empty string, it refers to the module of the current
+// instance.
+// If version is empty, it refers to the version of the current instance if
+// valid, or the default version of the module of the current instance.
+// If instance is empty, ModuleHostname returns the load-balancing
+// hostname.
+func ModuleHostname(c appengine.Context, module, version, instance string) (string, error) {
+	return appengine.ModuleHostname(c, module, version, instance)
+}
+
+// IsInvalidVersion reports whether err is a modules API error indicating
+// that the requested module or version does not exist.
+func IsInvalidVersion(err error) bool {
+	return isModulesError(err, modpb.ModulesServiceError_INVALID_VERSION)
+}
+
+// IsTransient reports whether err is a modules API error that is likely to
+// succeed if retried.
+func IsTransient(err error) bool {
+	return isModulesError(err, modpb.ModulesServiceError_TRANSIENT_ERROR)
+}
+
+func isModulesError(err error, code modpb.ModulesServiceError_ErrorCode) bool {
+	ae, ok := err.(*appengine_internal.APIError)
+	return ok && ae.Service == "modules" && ae.Code == int32(code)
+}
+
+func proto64(i int64) *int64 { return &i }
@@ -0,0 +1,205 @@
+// Copyright 2011 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package tokencache provides a cache for appengine.AccessToken, so that
+// applications issuing outbound requests on every inbound request don't
+// hit the app_identity service for every one of them.
+package tokencache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultPreExpiry is how far ahead of a cached token's actual expiry it
+// is considered stale and refreshed.
+const DefaultPreExpiry = 5 * time.Minute
+
+// Metrics receives hit/miss/refresh/error counts as a TokenCache serves or
+// refreshes tokens, so callers can plug in their own telemetry. scopeKey
+// is the cache key for the scope set involved, as joined by ScopeKey.
+type Metrics interface {
+	Hit(scopeKey string)
+	Miss(scopeKey string)
+	Refresh(scopeKey string)
+	Error(scopeKey string, err error)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Hit(string)          {}
+func (noopMetrics) Miss(string)         {}
+func (noopMetrics) Refresh(string)      {}
+func (noopMetrics) Error(string, error) {}
+
+// ScopeKey returns the cache key TokenCache uses for a scope set: its
+// members sorted and joined with spaces, so that equivalent scope sets
+// presented in different orders share a cache entry.
+func ScopeKey(scopes []string) string {
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, " ")
+}
+
+type cacheEntry struct {
+	token  string
+	expiry time.Time
+}
+
+// TokenCache memoizes appengine.AccessToken, keyed by the sorted scope
+// tuple requested, serving cached tokens until PreExpiry before their
+// expiry. Concurrent misses for the same scope set are coalesced so that
+// only one app_identity RPC is in flight per scope set at a time. The zero
+// value is a usable TokenCache with DefaultPreExpiry and no metrics; use
+// New to configure either.
+type TokenCache struct {
+	// PreExpiry is the refresh window; zero means DefaultPreExpiry.
+	PreExpiry time.Duration
+	// Metrics, if non-nil, is notified of cache hits, misses, refreshes
+	// and errors.
+	Metrics Metrics
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	group   singleflight.Group
+}
+
+// New returns a TokenCache that refreshes tokens preExpiry before they
+// expire and reports hit/miss/refresh counts to metrics. A zero preExpiry
+// selects DefaultPreExpiry; a nil metrics discards the counts.
+func New(preExpiry time.Duration, metrics Metrics) *TokenCache {
+	return &TokenCache{PreExpiry: preExpiry, Metrics: metrics}
+}
+
+func (tc *TokenCache) preExpiry() time.Duration {
+	if tc.PreExpiry <= 0 {
+		return DefaultPreExpiry
+	}
+	return tc.PreExpiry
+}
+
+func (tc *TokenCache) metrics() Metrics {
+	if tc.Metrics == nil {
+		return noopMetrics{}
+	}
+	return tc.Metrics
+}
+
+// AccessToken returns a token for scopes, from cache if a sufficiently
+// fresh one is available, or by calling appengine.AccessToken otherwise.
+func (tc *TokenCache) AccessToken(c appengine.Context, scopes ...string) (token string, expiry time.Time, err error) {
+	key := ScopeKey(scopes)
+
+	tc.mu.Lock()
+	e, ok := tc.entries[key]
+	tc.mu.Unlock()
+	if ok && time.Until(e.expiry) > tc.preExpiry() {
+		tc.metrics().Hit(key)
+		return e.token, e.expiry, nil
+	}
+	tc.metrics().Miss(key)
+
+	v, err, _ := tc.group.Do(key, func() (interface{}, error) {
+		token, expiry, err := appengine.AccessToken(c, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		e := cacheEntry{token: token, expiry: expiry}
+		tc.mu.Lock()
+		if tc.entries == nil {
+			tc.entries = make(map[string]cacheEntry)
+		}
+		tc.entries[key] = e
+		tc.mu.Unlock()
+		tc.metrics().Refresh(key)
+		return e, nil
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	e = v.(cacheEntry)
+	return e.token, e.expiry, nil
+}
+
+// TokenResult is the outcome of fetching an access token for one scope set
+// passed to BatchAccessTokens.
+type TokenResult struct {
+	Token  string
+	Expiry time.Time
+	Err    error
+}
+
+// BatchAccessTokens fetches a token for each scope set in scopeSets
+// concurrently, through AccessToken, and returns one TokenResult per
+// scope set in the same order. It returns a non-nil error only if every
+// scope set failed; otherwise check each TokenResult.Err individually.
+func (tc *TokenCache) BatchAccessTokens(c appengine.Context, scopeSets [][]string) ([]TokenResult, error) {
+	results := make([]TokenResult, len(scopeSets))
+	var wg sync.WaitGroup
+	wg.Add(len(scopeSets))
+	for i, scopes := range scopeSets {
+		i, scopes := i, scopes
+		go func() {
+			defer wg.Done()
+			token, expiry, err := tc.AccessToken(c, scopes...)
+			results[i] = TokenResult{Token: token, Expiry: expiry, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	if len(results) == 0 {
+		return results, nil
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			return results, nil
+		}
+	}
+	return results, results[0].Err
+}
+
+// RefreshLoop calls AccessToken for scopes every interval, to keep the
+// cache entry for scopes warm, until ctx is cancelled, returning nil once
+// it does. interval must be positive; RefreshLoop returns an error
+// immediately rather than letting time.NewTicker panic on a zero or
+// negative one. A classic appengine.Context is only valid for the
+// lifetime of the request that created it, so RefreshLoop cannot simply
+// capture one and reuse it across ticks: it calls newContext on every
+// tick to obtain a Context good for that refresh (for example one sourced
+// from a keepalive request, or from appengine.BackgroundContext() on
+// runtimes that support it). Errors from newContext or AccessToken are
+// reported through Metrics.Error rather than dropped silently. It is
+// meant to be run in its own goroutine by long-lived background workers,
+// e.g. "go cache.RefreshLoop(ctx, scopes, 4*time.Minute, newContext)".
+func (tc *TokenCache) RefreshLoop(ctx context.Context, scopes []string, interval time.Duration, newContext func() (appengine.Context, error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("tokencache: RefreshLoop interval must be positive, got %s", interval)
+	}
+	key := ScopeKey(scopes)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			c, err := newContext()
+			if err != nil {
+				tc.metrics().Error(key, err)
+				continue
+			}
+			if _, _, err := tc.AccessToken(c, scopes...); err != nil {
+				tc.metrics().Error(key, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2011 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package tokencache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"appengine"
+	pb "appengine_internal/app_identity"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestScopeKey(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"a"}, "a"},
+		{[]string{"b", "a"}, "a b"},
+		{[]string{"a", "b"}, "a b"},
+	}
+	for _, tt := range tests {
+		if got := ScopeKey(tt.scopes); got != tt.want {
+			t.Errorf("ScopeKey(%v) = %q, want %q", tt.scopes, got, tt.want)
+		}
+	}
+}
+
+func TestScopeKeyDoesNotMutateInput(t *testing.T) {
+	scopes := []string{"b", "a"}
+	ScopeKey(scopes)
+	if scopes[0] != "b" || scopes[1] != "a" {
+		t.Errorf("ScopeKey mutated its argument: got %v, want [b a]", scopes)
+	}
+}
+
+// fakeMetrics counts Hit calls and panics on Miss, Refresh or Error, so a
+// test can assert that AccessToken was served from the cache.
+type fakeMetrics struct {
+	mu   sync.Mutex
+	hits int
+}
+
+func (m *fakeMetrics) Hit(string) {
+	m.mu.Lock()
+	m.hits++
+	m.mu.Unlock()
+}
+func (m *fakeMetrics) Miss(string)         { panic("unexpected Miss: AccessToken should have hit the cache") }
+func (m *fakeMetrics) Refresh(string)      { panic("unexpected Refresh: AccessToken should have hit the cache") }
+func (m *fakeMetrics) Error(string, error) { panic("unexpected Error: AccessToken should have hit the cache") }
+
+func TestAccessTokenServesFreshEntryFromCache(t *testing.T) {
+	metrics := &fakeMetrics{}
+	tc := New(0, metrics)
+	key := ScopeKey([]string{"scope-a", "scope-b"})
+	tc.entries = map[string]cacheEntry{
+		key: {token: "cached-token", expiry: time.Now().Add(time.Hour)},
+	}
+
+	// A fresh cache entry is served without ever calling
+	// appengine.AccessToken, so passing a nil Context is safe here.
+	token, _, err := tc.AccessToken(nil, "scope-a", "scope-b")
+	if err != nil {
+		t.Fatalf("AccessToken returned error %v, want nil", err)
+	}
+	if token != "cached-token" {
+		t.Errorf("AccessToken token = %q, want %q", token, "cached-token")
+	}
+	if metrics.hits != 1 {
+		t.Errorf("metrics.hits = %d, want 1", metrics.hits)
+	}
+}
+
+func TestAccessTokenTreatsEntryWithinPreExpiryAsStale(t *testing.T) {
+	tc := New(5*time.Minute, nil)
+	key := ScopeKey([]string{"scope"})
+	tc.entries = map[string]cacheEntry{
+		key: {token: "about-to-expire", expiry: time.Now().Add(time.Minute)},
+	}
+
+	// The entry expires within the PreExpiry window, so AccessToken must
+	// fall through to appengine.AccessToken(c, ...), which panics on a
+	// nil Context -- proving the stale entry was not served from cache.
+	defer func() {
+		if recover() == nil {
+			t.Error("AccessToken served a within-PreExpiry entry from cache")
+		}
+	}()
+	tc.AccessToken(nil, "scope")
+}
+
+// fakeAccessTokenContext is a minimal appengine.Context standing in for
+// the app_identity service's GetAccessToken RPC. delay, if set, is slept
+// before responding, to widen the window in which concurrent callers can
+// race into AccessToken. fail, if set, lets a test reject specific scope
+// sets instead of returning token.
+type fakeAccessTokenContext struct {
+	appengine.Context
+	token string
+	delay time.Duration
+	fail  func(scopes []string) error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *fakeAccessTokenContext) Call(service, method string, in, out proto.Message, opts *appengine.CallOptions) error {
+	if service != "app_identity_service" || method != "GetAccessToken" {
+		return fmt.Errorf("fakeAccessTokenContext: unexpected %s.%s", service, method)
+	}
+	req := in.(*pb.GetAccessTokenRequest)
+
+	f.mu.Lock()
+	f.calls++
+	f.mu.Unlock()
+
+	if f.delay > 0 {
+		time.Sleep(f.delay)
+	}
+	if f.fail != nil {
+		if err := f.fail(req.Scope); err != nil {
+			return err
+		}
+	}
+	res := out.(*pb.GetAccessTokenResponse)
+	res.AccessToken = proto.String(f.token)
+	res.ExpirationTime = proto.Int64(time.Now().Add(time.Hour).Unix())
+	return nil
+}
+
+func TestAccessTokenCoalescesConcurrentMisses(t *testing.T) {
+	tc := New(0, nil)
+	fc := &fakeAccessTokenContext{token: "shared-token", delay: 50 * time.Millisecond}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			token, _, err := tc.AccessToken(fc, "scope")
+			if err != nil {
+				t.Errorf("AccessToken returned error %v, want nil", err)
+			}
+			if token != "shared-token" {
+				t.Errorf("AccessToken token = %q, want %q", token, "shared-token")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fc.calls != 1 {
+		t.Errorf("underlying GetAccessToken RPC ran %d times, want 1 (concurrent misses should be coalesced)", fc.calls)
+	}
+}
+
+func TestBatchAccessTokensPartialFailure(t *testing.T) {
+	tc := New(0, nil)
+	fc := &fakeAccessTokenContext{
+		token: "tok",
+		fail: func(scopes []string) error {
+			if scopes[0] == "bad" {
+				return errors.New("boom")
+			}
+			return nil
+		},
+	}
+
+	results, err := tc.BatchAccessTokens(fc, [][]string{{"good"}, {"bad"}})
+	if err != nil {
+		t.Fatalf("BatchAccessTokens returned error %v, want nil (only some scope sets failed)", err)
+	}
+	if results[0].Err != nil || results[0].Token != "tok" {
+		t.Errorf("results[0] = %+v, want Token %q and no error", results[0], "tok")
+	}
+	if results[1].Err == nil {
+		t.Error("results[1].Err = nil, want the injected failure")
+	}
+}
+
+func TestBatchAccessTokensAllFail(t *testing.T) {
+	tc := New(0, nil)
+	fc := &fakeAccessTokenContext{
+		fail: func(scopes []string) error { return errors.New("boom") },
+	}
+
+	_, err := tc.BatchAccessTokens(fc, [][]string{{"a"}, {"b"}})
+	if err == nil {
+		t.Error("BatchAccessTokens returned nil error when every scope set failed")
+	}
+}
+
+func TestRefreshLoopRejectsNonPositiveInterval(t *testing.T) {
+	tc := New(0, nil)
+	err := tc.RefreshLoop(context.Background(), []string{"scope"}, 0, func() (appengine.Context, error) {
+		return nil, nil
+	})
+	if err == nil {
+		t.Error("RefreshLoop(interval=0) returned nil error, want an error")
+	}
+}
+
+// recordingMetrics reports Error calls on errCh so tests can wait for
+// RefreshLoop to observe a failed tick without a fixed sleep.
+type recordingMetrics struct {
+	errCh chan string
+}
+
+func (m *recordingMetrics) Hit(string)     {}
+func (m *recordingMetrics) Miss(string)    {}
+func (m *recordingMetrics) Refresh(string) {}
+func (m *recordingMetrics) Error(key string, err error) {
+	select {
+	case m.errCh <- key:
+	default:
+	}
+}
+
+func TestRefreshLoopReportsNewContextError(t *testing.T) {
+	metrics := &recordingMetrics{errCh: make(chan string, 1)}
+	tc := New(0, metrics)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tc.RefreshLoop(ctx, []string{"scope"}, time.Millisecond, func() (appengine.Context, error) {
+			return nil, errors.New("no context available")
+		})
+	}()
+
+	wantKey := ScopeKey([]string{"scope"})
+	select {
+	case key := <-metrics.errCh:
+		if key != wantKey {
+			t.Errorf("Error reported for key %q, want %q", key, wantKey)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RefreshLoop did not report a Metrics.Error within 1s")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("RefreshLoop returned error %v after ctx cancellation, want nil", err)
+	}
+}